@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"strings"
+	"time"
+)
+
+// How long registration (CAP LS through CAP END, including SASL) may take
+// before we give up on the server. register() runs before Consume starts
+// enforcing its own read deadline, so without this a server that never
+// finishes (or never answers AUTHENTICATE) would wedge the connect call
+// forever.
+const registrationTimeout = 30 * time.Second
+
+// Capabilities hatcog will request from the server if advertised. "sasl" is
+// handled specially: when requested and ACKed, it triggers the SASL
+// exchange below before CAP END is sent.
+var wantedCaps = []string{
+	"sasl",
+	"server-time",
+	"message-tags",
+	"account-notify",
+	"multi-prefix",
+	"extended-join",
+	"away-notify",
+}
+
+// Maximum length of an AUTHENTICATE payload chunk, per the SASL IRCv3 spec.
+const saslChunkSize = 400
+
+// negotiateCaps runs the IRCv3 CAP (and, if offered, SASL) handshake on a
+// freshly dialed, not-yet-registered connection. CAP LS must already have
+// been sent, and NICK/USER must already be queued, before this is called.
+// It reads directly from self.reader, so it must finish (including sending
+// CAP END) before Consume starts reading from the same socket.
+func (self *External) negotiateCaps() {
+
+	advertised := self.readCapLS()
+	self.caps = advertised
+
+	if sts, ok := advertised["sts"]; ok {
+		learnSts(self.config.Server, requiresTLS(self.config), sts)
+	}
+
+	var requested []string
+	for _, want := range wantedCaps {
+		if _, ok := advertised[want]; ok {
+			requested = append(requested, want)
+		}
+	}
+
+	if len(requested) == 0 {
+		self.SendRaw("CAP END")
+		return
+	}
+
+	self.SendRaw("CAP REQ :" + strings.Join(requested, " "))
+	acked := self.readCapAck()
+
+	if acked["sasl"] {
+		self.doSASL()
+	}
+
+	self.SendRaw("CAP END")
+}
+
+// readCapLS reads "CAP * LS" lines (possibly spread across several
+// multiline "CAP * LS *" replies, per CAP LS 302) until the final one, and
+// returns the union of advertised capabilities to their (possibly empty)
+// values.
+func (self *External) readCapLS() map[string]string {
+
+	caps := map[string]string{}
+
+	for {
+		line, err := self.readRegistrationLine()
+		if err != nil {
+			log.Println("CAP LS read error:", err)
+			return caps
+		}
+
+		if !isCapReply(line, "LS") {
+			continue
+		}
+
+		more, lineCaps := parseCapList(line)
+		for name, value := range lineCaps {
+			caps[name] = value
+		}
+		if !more {
+			return caps
+		}
+	}
+}
+
+// readCapAck reads until a "CAP * ACK" or "CAP * NAK" reply and returns
+// which of the requested capabilities were actually acknowledged.
+func (self *External) readCapAck() map[string]bool {
+
+	acked := map[string]bool{}
+
+	for {
+		line, err := self.readRegistrationLine()
+		if err != nil {
+			log.Println("CAP REQ read error:", err)
+			return acked
+		}
+
+		if isCapReply(line, "NAK") {
+			return acked
+		}
+
+		if isCapReply(line, "ACK") {
+			_, caps := parseCapList(line)
+			for name := range caps {
+				acked[name] = true
+			}
+			return acked
+		}
+	}
+}
+
+// readRegistrationLine reads the next line during CAP/SASL negotiation,
+// transparently answering (and swallowing) any PING the server sends
+// before registration finishes. Several ircds/bouncers ping early as an
+// anti-spoofing check; nothing else reads this socket until Consume starts
+// after CAP END, so without this the server would see an unresponsive
+// client and the connection could be closed, or negotiation would just
+// sit there until registrationTimeout.
+func (self *External) readRegistrationLine() (string, error) {
+	for {
+		line, err := self.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		self.rawLog.Println(line)
+
+		if token, ok := pingToken(line); ok {
+			self.SendRaw("PONG :" + token)
+			continue
+		}
+
+		return line, nil
+	}
+}
+
+// pingToken reports whether a raw line (optionally ":source"-prefixed) is a
+// PING, and if so returns the token it must be echoed back with. ircds and
+// bouncers commonly use this exchange as an anti-spoofing check before
+// completing registration, so the reply must carry the same token back
+// rather than an arbitrary one.
+func pingToken(line string) (token string, ok bool) {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) > 1 && fields[0] == "PING":
+		return strings.TrimPrefix(fields[1], ":"), true
+	case len(fields) > 2 && fields[1] == "PING":
+		return strings.TrimPrefix(fields[2], ":"), true
+	default:
+		return "", false
+	}
+}
+
+// isCapReply reports whether line is a "[:source] CAP <nick-or-*>
+// <subcommand>" reply. Scanning for the "CAP" token rather than assuming a
+// fixed position lets this match both a server's real replies (which carry
+// a leading ":source" prefix) and a bare "CAP <nick-or-*> <subcommand>".
+func isCapReply(line string, subcommand string) bool {
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if field == "CAP" {
+			return i+2 < len(fields) && fields[i+2] == subcommand
+		}
+	}
+	return false
+}
+
+// parseCapList extracts the trailing capability list from a CAP LS/ACK/NAK
+// line and reports whether a CAP LS 302 multiline reply has more to come
+// (indicated by a "*" parameter just before the trailing list).
+func parseCapList(line string) (more bool, caps map[string]string) {
+
+	caps = map[string]string{}
+
+	line = strings.TrimRight(line, "\r\n")
+	idx := strings.Index(line, " :")
+	if idx == -1 {
+		return false, caps
+	}
+
+	prefix := line[:idx]
+	more = strings.HasSuffix(prefix, " *")
+
+	for _, token := range strings.Fields(line[idx+2:]) {
+		parts := strings.SplitN(token, "=", 2)
+		if len(parts) == 2 {
+			caps[parts[0]] = parts[1]
+		} else {
+			caps[parts[0]] = ""
+		}
+	}
+
+	return more, caps
+}
+
+// doSASL runs the AUTHENTICATE exchange described in the IRCv3 SASL spec,
+// using self.config.SASLMechanism ("PLAIN" or "EXTERNAL", defaulting to
+// PLAIN). Numerics 903 (success) and 904/905 (failure) end the exchange.
+func (self *External) doSASL() {
+
+	mechanism := self.config.SASLMechanism
+	if mechanism == "" {
+		mechanism = "PLAIN"
+	}
+
+	self.SendRaw("AUTHENTICATE " + mechanism)
+
+	line, err := self.readRegistrationLine()
+	if err != nil {
+		log.Println("SASL read error:", err)
+		return
+	}
+
+	if !strings.Contains(line, "AUTHENTICATE +") {
+		log.Println("SASL: server did not prompt for credentials:", strings.TrimSpace(line))
+		return
+	}
+
+	var payload []byte
+	if mechanism == "EXTERNAL" {
+		payload = []byte{}
+	} else {
+		payload = []byte("\x00" + self.config.SASLUser + "\x00" + self.config.SASLPassword)
+	}
+	self.sendSASLPayload(payload)
+
+	for {
+		line, err := self.readRegistrationLine()
+		if err != nil {
+			log.Println("SASL read error:", err)
+			return
+		}
+
+		switch {
+		case strings.Contains(line, " 903 "):
+			log.Println("SASL authentication succeeded")
+			self.isIdentified = true
+			return
+		case strings.Contains(line, " 904 "), strings.Contains(line, " 905 "):
+			log.Println("SASL authentication failed:", strings.TrimSpace(line))
+			return
+		}
+	}
+}
+
+// sendSASLPayload base64-encodes payload and sends it as one or more
+// AUTHENTICATE lines, chunked to saslChunkSize bytes as required by the
+// spec. A response exactly saslChunkSize bytes long must be followed by an
+// empty "AUTHENTICATE +" to signal the end of the payload.
+func (self *External) sendSASLPayload(payload []byte) {
+
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	if encoded == "" {
+		self.SendRaw("AUTHENTICATE +")
+		return
+	}
+
+	chunk := 0
+	for i := 0; i < len(encoded); i += saslChunkSize {
+		end := i + saslChunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		self.SendRaw("AUTHENTICATE " + encoded[i:end])
+		chunk = end - i
+	}
+
+	if chunk == saslChunkSize {
+		self.SendRaw("AUTHENTICATE +")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsCapReply(t *testing.T) {
+	cases := []struct {
+		line       string
+		subcommand string
+		want       bool
+	}{
+		{":irc.example.com CAP * LS :sasl multi-prefix\r\n", "LS", true},
+		{":irc.example.com CAP * ACK :sasl\r\n", "ACK", true},
+		{":irc.example.com CAP * NAK :sasl\r\n", "ACK", false},
+		{":irc.example.com NOTICE * :hi\r\n", "LS", false},
+	}
+
+	for _, c := range cases {
+		if got := isCapReply(c.line, c.subcommand); got != c.want {
+			t.Errorf("isCapReply(%q, %q) = %v, want %v", c.line, c.subcommand, got, c.want)
+		}
+	}
+}
+
+func TestPingToken(t *testing.T) {
+	cases := []struct {
+		line      string
+		wantToken string
+		wantOK    bool
+	}{
+		{"PING :irc.example.com\r\n", "irc.example.com", true},
+		{":irc.example.com PING :token\r\n", "token", true},
+		{":irc.example.com CAP * LS :sasl\r\n", "", false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		token, ok := pingToken(c.line)
+		if ok != c.wantOK || token != c.wantToken {
+			t.Errorf("pingToken(%q) = (%q, %v), want (%q, %v)", c.line, token, ok, c.wantToken, c.wantOK)
+		}
+	}
+}
+
+func TestParseCapList(t *testing.T) {
+	more, caps := parseCapList(":irc.example.com CAP * LS * :sasl=PLAIN,EXTERNAL multi-prefix\r\n")
+	if !more {
+		t.Error("expected more=true for a \"CAP * LS *\" reply")
+	}
+	want := map[string]string{"sasl": "PLAIN,EXTERNAL", "multi-prefix": ""}
+	if !reflect.DeepEqual(caps, want) {
+		t.Errorf("caps = %v, want %v", caps, want)
+	}
+
+	more, caps = parseCapList(":irc.example.com CAP * LS :away-notify\r\n")
+	if more {
+		t.Error("expected more=false for a final \"CAP * LS\" reply")
+	}
+	want = map[string]string{"away-notify": ""}
+	if !reflect.DeepEqual(caps, want) {
+		t.Errorf("caps = %v, want %v", caps, want)
+	}
+}
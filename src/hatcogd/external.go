@@ -3,12 +3,17 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
+
+	"golang.org/x/net/proxy"
 )
 
 const (
@@ -17,6 +22,9 @@ const (
 	// Standard IRC SSL port
 	// http://blog.freenode.net/2011/02/port-6697-irc-via-tlsssl/
 	SSL_PORT = "6697"
+
+	// How long to wait for a direct (non-proxied) TCP connect before giving up
+	CONNECT_TIMEOUT = 10 * time.Second
 )
 
 /*******************
@@ -32,12 +40,15 @@ func NewExternalManager(fromServer chan *Line) *ExternalManager {
 	return &ExternalManager{make(map[string]*External), fromServer}
 }
 
-func (self *ExternalManager) Connect(addr string) {
+// Connect to an IRC server using the given registration/proxy/SASL settings.
+func (self *ExternalManager) Connect(config ExternalConfig) {
 
-	if self.connections[addr] == nil {
-		self.connections[addr] = NewExternal(addr, self.fromServer)
-		log.Println("Connected to IRC server", addr)
-		go self.connections[addr].Consume()
+	if self.connections[config.Server] == nil {
+		replay := newRingBuffer(replayBufferSize)
+
+		self.connections[config.Server] = NewExternal(config, self.fromServer, replay)
+		log.Println("Connected to IRC server", config.Server)
+		go self.connections[config.Server].Consume()
 	}
 }
 
@@ -57,8 +68,41 @@ func (self *ExternalManager) doCommand(network, content string) {
 	self.connections[network].doCommand(content)
 }
 
+// SendRaw writes a raw IRC line to the named network's connection, for
+// clients (like the websocket gateway) that speak IRC directly rather than
+// hatcog's "/cmd" client protocol. Reports false if the network isn't
+// connected.
+func (self *ExternalManager) SendRaw(network, raw string) bool {
+	conn := self.connections[network]
+	if conn == nil {
+		return false
+	}
+	conn.SendRaw(raw)
+	return true
+}
+
+// Subscribe registers for a feed of raw IRC lines from the named network,
+// in addition to the fromServer channel every connection already feeds.
+// Reports false if the network isn't connected.
+func (self *ExternalManager) Subscribe(network string) (int, <-chan string, bool) {
+	conn := self.connections[network]
+	if conn == nil {
+		return 0, nil, false
+	}
+	id, ch := conn.Subscribe()
+	return id, ch, true
+}
+
+// Unsubscribe removes a feed registered with Subscribe.
+func (self *ExternalManager) Unsubscribe(network string, id int) {
+	if conn := self.connections[network]; conn != nil {
+		conn.Unsubscribe(id)
+	}
+}
+
 func (self *ExternalManager) Close() error {
 	for _, conn := range self.connections {
+		conn.Stop()
 		conn.Close()
 	}
 	self.connections = nil
@@ -69,29 +113,104 @@ func (self *ExternalManager) Close() error {
  * External *
  ************/
 
+// ExternalConfig holds everything needed to dial and register a connection
+// to an IRC server: the address to dial, nick/user registration info, an
+// optional proxy to dial through, and optional SASL credentials.
+type ExternalConfig struct {
+	Server   string
+	Nick     string
+	User     string
+	RealName string
+
+	// ProxyURL, when non-empty, routes the connection through a SOCKS5
+	// proxy, e.g. "socks5://127.0.0.1:9050" for a local Tor daemon.
+	ProxyURL string
+
+	// SASLMechanism is "PLAIN" or "EXTERNAL"; "" means PLAIN. SASL runs
+	// whenever the server advertises and acknowledges the sasl capability;
+	// Identify remains the NickServ path once registered.
+	SASLMechanism  string
+	SASLUser       string
+	SASLPassword   string
+	ClientCertPath string
+
+	// MaxReconnectAttempts caps how many times Consume will redial after a
+	// dropped connection before giving up entirely. 0 means use
+	// defaultMaxReconnectAttempts.
+	MaxReconnectAttempts int
+
+	// SendRate and SendBurst configure the outgoing token bucket (messages
+	// per second, and how many may go out in a burst). 0 means use
+	// defaultSendRate / defaultSendBurst.
+	SendRate  float64
+	SendBurst int
+
+	// PinnedSPKIHashes, if non-empty, restricts TLS connections to
+	// certificates whose hex-encoded SHA-256(SPKI) matches one of these.
+	PinnedSPKIHashes []string
+
+	// Insecure disables PinnedSPKIHashes enforcement (each occurrence is
+	// still logged loudly). It never disables normal certificate
+	// validation (chain, hostname, expiry).
+	Insecure bool
+
+	// forceTLS is set by applySts when a stored STS policy rewrites Server
+	// to a non-standard port: isSSLAddr can't recognize that port as TLS
+	// by suffix alone, so without this dialServer would downgrade an
+	// STS-upgraded address to a plaintext connection.
+	forceTLS bool
+}
+
 type External struct {
-	socket       net.Conn
-	fromServer   chan *Line
-	rawLog       *log.Logger
+	mu         sync.RWMutex
+	socket     net.Conn
+	connected  bool
+	config     ExternalConfig
+	reader     *bufio.Reader
+	caps       map[string]string
+	fromServer chan *Line
+	rawLog     *log.Logger
+
+	replay   *ringBuffer
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	channelsMu sync.Mutex
+	channels   map[string]bool
+
+	// sendCh carries rate-limited outgoing traffic (PRIVMSG, JOIN, ...);
+	// priorityCh carries traffic that must never wait on the token bucket
+	// (PONG, CAP, AUTHENTICATE). Both are drained by runSender.
+	sendCh     chan string
+	priorityCh chan string
+
+	ownMaskMu sync.RWMutex
+	ownMask   string // nick!user@host, learned from the server's own traffic
+
+	isupportMu sync.RWMutex
+	lineLen    int // RPL_ISUPPORT LINELEN, 0 until learned
+	maxTargets int // RPL_ISUPPORT MAXTARGETS, 0 until learned
+
+	perTargetMu      sync.Mutex
+	perTargetBuckets map[string]*targetBucket
+
+	subsMu    sync.Mutex
+	subs      map[int]chan string
+	nextSubID int
+
 	isIdentified bool
 }
 
-func NewExternal(server string, fromServer chan *Line) *External {
+func NewExternal(config ExternalConfig, fromServer chan *Line, replay *ringBuffer) *External {
 
 	logFilename := HOME + LOG_DIR + "server_raw.log"
 	logFile := openLogFile(logFilename)
 	rawLog := log.New(logFile, "", log.LstdFlags)
 	log.Println("Logging raw IRC messages to:", logFilename)
 
-	var socket net.Conn
-	var err error
-
-	if strings.HasSuffix(server, SSL_PORT) {
-		socket, err = tls.Dial("tcp", server, nil)
-	} else {
-		socket, err = net.Dial("tcp", server)
-	}
+	applySts(&config)
 
+	socket, err := dialServer(config)
 	if err != nil {
 		log.Fatal("Error connecting to IRC server:", err)
 	}
@@ -99,14 +218,116 @@ func NewExternal(server string, fromServer chan *Line) *External {
 
 	conn := External{
 		socket:     socket,
+		connected:  true,
+		config:     config,
+		reader:     bufio.NewReader(socket),
 		fromServer: fromServer,
 		rawLog:     rawLog,
+		replay:     replay,
+		stopCh:     make(chan struct{}),
+		channels:   make(map[string]bool),
+		sendCh:     make(chan string, 256),
+		priorityCh: make(chan string, 32),
 	}
 
+	go conn.runSender()
+	conn.register()
+
 	return &conn
 }
 
-// Identify with NickServ. Must of already sent NICK.
+// register sends NICK/USER and runs CAP/SASL negotiation. Used both for the
+// initial connection and again after each reconnect.
+func (self *External) register() {
+	self.SendRaw("CAP LS 302")
+	self.SendRaw("NICK " + self.config.Nick)
+	self.SendRaw("USER " + self.config.User + " 0 * :" + self.config.RealName)
+
+	self.socket.SetReadDeadline(time.Now().Add(registrationTimeout))
+	self.negotiateCaps()
+	self.socket.SetReadDeadline(time.Time{})
+}
+
+// isSSLAddr reports whether server is hatcog's standard TLS port.
+func isSSLAddr(server string) bool {
+	return strings.HasSuffix(server, SSL_PORT)
+}
+
+// requiresTLS reports whether config's connection must be negotiated over
+// TLS: either server is the standard SSL_PORT, or applySts pinned it to a
+// non-standard TLS port that isSSLAddr can't recognize by suffix alone.
+func requiresTLS(config ExternalConfig) bool {
+	return isSSLAddr(config.Server) || config.forceTLS
+}
+
+// Dial the IRC server described by config, optionally through a SOCKS5
+// proxy (config.ProxyURL like "socks5://127.0.0.1:9050"). TLS is negotiated
+// on top of the proxy-dialed connection when required, since tls.Dial
+// can't use a proxy.Dialer directly. On the non-proxy path the TCP connect
+// is bounded by CONNECT_TIMEOUT, and on either path the TLS handshake gets
+// a further CONNECT_TIMEOUT of its own, so an unreachable or firewalled
+// host fails instead of hanging NewExternal/reconnect forever.
+func dialServer(config ExternalConfig) (net.Conn, error) {
+
+	server := config.Server
+	isSSL := requiresTLS(config)
+
+	var socket net.Conn
+
+	if config.ProxyURL == "" {
+		netDialer := &net.Dialer{Timeout: CONNECT_TIMEOUT}
+		conn, err := netDialer.Dial("tcp", server)
+		if err != nil {
+			return nil, err
+		}
+		socket = conn
+	} else {
+		parsed, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %v", config.ProxyURL, err)
+		}
+
+		dialer, err := proxy.FromURL(parsed, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("building proxy dialer for %q: %v", config.ProxyURL, err)
+		}
+
+		conn, err := dialer.Dial("tcp", server)
+		if err != nil {
+			return nil, err
+		}
+		socket = conn
+	}
+
+	if !isSSL {
+		return socket, nil
+	}
+
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+
+	tlsConfig, err := buildTlsConfig(host, config)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	socket.SetDeadline(time.Now().Add(CONNECT_TIMEOUT))
+	tlsConn := tls.Client(socket, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// Identify with NickServ. Fallback path for servers that don't advertise
+// the sasl capability; prefer SASL (negotiated in NewExternal) when available.
+// Must of already sent NICK.
 func (self *External) Identify(password string) {
 	if !self.isIdentified {
 		log.Println("Identifying with NickServ")
@@ -115,10 +336,16 @@ func (self *External) Identify(password string) {
 	}
 }
 
-// Send a regular (non-system command) IRC message
+// Send a regular (non-system command) IRC message. A comma-separated
+// channel list is split into groups obeying the server's MAXTARGETS, and
+// messages that won't fit in one IRC line are split on word boundaries
+// into several PRIVMSGs.
 func (self *External) SendMessage(channel, msg string) {
-	fullmsg := "PRIVMSG " + channel + " :" + msg
-	self.SendRaw(fullmsg)
+	for _, group := range self.targetGroups(channel) {
+		for _, chunk := range self.splitMessage(group, msg) {
+			self.SendRaw("PRIVMSG " + group + " :" + chunk)
+		}
+	}
 }
 
 // Send a /me action message
@@ -127,17 +354,58 @@ func (self *External) SendAction(channel, msg string) {
 	self.SendRaw(fullmsg)
 }
 
-// Send message down socket. Add \n at end first.
+// Queue a message to be sent down the socket. PONG/CAP/AUTHENTICATE traffic
+// jumps the priority lane (see runSender); everything else is rate limited
+// by the token bucket to stay under the server's flood protection.
 func (self *External) SendRaw(msg string) {
 
-	var err error
-	msg = msg + "\n"
+	ch := self.sendCh
+	if isPriorityCommand(msg) {
+		ch = self.priorityCh
+	}
+
+	select {
+	case ch <- msg:
+	default:
+		log.Println("Send queue full, dropping message:", msg)
+	}
+}
+
+// isConnected reports whether the socket is currently up.
+func (self *External) isConnected() bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.connected
+}
+
+// dispatch actually writes msg to the wire. While a reconnect is in
+// progress, it's queued on the replay buffer and flushed once the
+// connection comes back instead of being dropped.
+func (self *External) dispatch(msg string) {
+
+	self.mu.RLock()
+	connected := self.connected
+	socket := self.socket
+	self.mu.RUnlock()
 
-	self.rawLog.Print(" -->", msg)
+	if !connected {
+		if self.replay != nil {
+			self.replay.Push(msg)
+		}
+		return
+	}
+
+	writeRaw(socket, self.rawLog, msg)
+}
+
+func writeRaw(socket net.Conn, rawLog *log.Logger, msg string) {
+
+	msg = msg + "\n"
+	rawLog.Print(" -->", msg)
 
-	_, err = self.socket.Write([]byte(msg))
+	_, err := socket.Write([]byte(msg))
 	if err != nil {
-		log.Fatal("Error writing to socket", err)
+		log.Println("Error writing to socket:", err)
 	}
 }
 
@@ -156,30 +424,42 @@ func (self *External) doCommand(content string) {
 	self.SendRaw(content)
 }
 
-// Read IRC messages from the connection and act on them
+// Read IRC messages from the connection and act on them. A dropped
+// connection (EOF or any non-timeout net.Error) triggers a reconnect with
+// backoff rather than killing the daemon; Consume only returns once
+// reconnecting is cancelled (Stop) or gives up (MaxReconnectAttempts).
 func (self *External) Consume() {
 
 	var contentData []byte
 	var content string
 	var err error
 
-	bufRead := bufio.NewReader(self.socket)
 	for {
 
-		self.socket.SetReadDeadline(time.Now().Add(ONE_SECOND_NS))
-		contentData, err = bufRead.ReadBytes('\n')
+		self.mu.RLock()
+		socket, reader := self.socket, self.reader
+		self.mu.RUnlock()
+
+		socket.SetReadDeadline(time.Now().Add(ONE_SECOND_NS))
+		contentData, err = reader.ReadBytes('\n')
 
 		if err != nil {
 			netErr, ok := err.(net.Error)
 			if ok && netErr.Timeout() == true {
 				continue
-			} else if err == io.EOF {
+			}
+
+			if err == io.EOF {
 				log.Println("IRC server closed connection.")
-				self.Close()
-				return // Exit main loop, quit working this connection
 			} else {
-				log.Fatal("Consume Error:", err)
+				log.Println("Consume error:", err)
 			}
+
+			if !self.reconnect() {
+				log.Println("Giving up on", self.config.Server, "after repeated reconnect failures")
+				return
+			}
+			continue
 		}
 
 		if len(contentData) == 0 {
@@ -189,6 +469,7 @@ func (self *External) Consume() {
 		content = toUnicode(contentData)
 
 		self.rawLog.Println(content)
+		self.broadcastRaw(content)
 
 		line, err := ParseLine(content)
 		if err == nil {
@@ -225,17 +506,111 @@ func toUnicode(data []byte) string {
 // Do something with a line
 func (self *External) act(line *Line) {
 
-	if line.Command == "PING" {
+	self.learnOwnMask(line)
+
+	switch line.Command {
+	case "PING":
 		// Reply, and send message on to client
 		self.SendRaw("PONG goirc")
-	} else if line.Command == "VERSION" {
+	case "VERSION":
 		versionMsg := "NOTICE " + line.User + " :\u0001VERSION " + VERSION + "\u0001\n"
 		self.SendRaw(versionMsg)
+	case "JOIN":
+		self.trackJoin(line)
+	case "PART":
+		self.trackPart(line)
+	case "005":
+		self.parseISupport(line)
 	}
 
 	self.fromServer <- line
 }
 
+// trackJoin records channels we've joined, keyed by name, so reconnect can
+// rejoin them. Only our own JOINs are tracked, not other users'.
+func (self *External) trackJoin(line *Line) {
+	if !self.isSelf(line) || len(line.Args) == 0 {
+		return
+	}
+
+	self.channelsMu.Lock()
+	self.channels[line.Args[0]] = true
+	self.channelsMu.Unlock()
+}
+
+func (self *External) trackPart(line *Line) {
+	if !self.isSelf(line) || len(line.Args) == 0 {
+		return
+	}
+
+	self.channelsMu.Lock()
+	delete(self.channels, line.Args[0])
+	self.channelsMu.Unlock()
+}
+
+// isSelf reports whether line was sent by our own nick, as opposed to
+// observing another user's JOIN/PART in a channel we're already in.
+func (self *External) isSelf(line *Line) bool {
+	nick := strings.SplitN(line.User, "!", 2)[0]
+	return nick == self.config.Nick
+}
+
 func (self *External) Close() error {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
 	return self.socket.Close()
 }
+
+// Stop cancels any in-flight reconnect backoff, causing Consume to return
+// instead of redialing. Safe to call multiple times.
+func (self *External) Stop() {
+	self.stopOnce.Do(func() { close(self.stopCh) })
+}
+
+// Subscribe registers a new feed of raw IRC lines seen on this connection,
+// alongside fromServer. Used by secondary frontends (e.g. the websocket
+// gateway) that want the wire-format lines directly. The returned id is
+// used to Unsubscribe later.
+func (self *External) Subscribe() (int, <-chan string) {
+	self.subsMu.Lock()
+	defer self.subsMu.Unlock()
+
+	if self.subs == nil {
+		self.subs = make(map[int]chan string)
+	}
+
+	id := self.nextSubID
+	self.nextSubID++
+
+	ch := make(chan string, 64)
+	self.subs[id] = ch
+
+	return id, ch
+}
+
+// Unsubscribe removes a feed registered with Subscribe.
+func (self *External) Unsubscribe(id int) {
+	self.subsMu.Lock()
+	defer self.subsMu.Unlock()
+
+	if ch, ok := self.subs[id]; ok {
+		close(ch)
+		delete(self.subs, id)
+	}
+}
+
+// broadcastRaw fans a raw line received from the server out to every
+// subscriber. A subscriber whose buffer is full misses that line (it stays
+// subscribed) rather than blocking Consume.
+func (self *External) broadcastRaw(raw string) {
+	self.subsMu.Lock()
+	defer self.subsMu.Unlock()
+
+	for _, ch := range self.subs {
+		select {
+		case ch <- raw:
+		default:
+			log.Println("Websocket subscriber too slow, dropping line")
+		}
+	}
+}
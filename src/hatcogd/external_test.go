@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestIsSSLAddr(t *testing.T) {
+	cases := map[string]bool{
+		"irc.example.com:6697": true,
+		"irc.example.com:6667": false,
+		"irc.example.com":      false,
+	}
+
+	for addr, want := range cases {
+		if got := isSSLAddr(addr); got != want {
+			t.Errorf("isSSLAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestDialServerInvalidProxyURL(t *testing.T) {
+	config := ExternalConfig{
+		Server:   "irc.example.com:6667",
+		ProxyURL: "://not-a-url",
+	}
+
+	if _, err := dialServer(config); err == nil {
+		t.Fatal("dialServer with a malformed ProxyURL: expected error, got nil")
+	}
+}
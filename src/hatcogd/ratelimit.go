@@ -0,0 +1,333 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultSendRate  = 2.0 // messages per second
+	defaultSendBurst = 5
+
+	// RFC 2812 line limit, used until the server's own LINELEN advertises
+	// something different via RPL_ISUPPORT.
+	defaultLineLen = 512
+
+	// Per-target limits, independent of the connection-wide bucket above:
+	// cap how fast we'll PRIVMSG any single target, so one noisy
+	// channel/query can't burn through the whole connection's burst
+	// allowance and starve traffic to everything else.
+	defaultPerTargetRate  = 1.0 // messages per second
+	defaultPerTargetBurst = 3
+)
+
+// runSender drains queued outgoing messages at the configured token-bucket
+// rate. Priority-lane traffic (PONG, CAP, AUTHENTICATE) is always sent
+// immediately, bypassing the bucket, so flood protection never delays
+// connection-critical traffic.
+func (self *External) runSender() {
+
+	rate := self.config.SendRate
+	if rate <= 0 {
+		rate = defaultSendRate
+	}
+	burst := self.config.SendBurst
+	if burst <= 0 {
+		burst = defaultSendBurst
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	tokens := burst
+
+	for {
+		// Always let priority traffic through first, win or lose on tokens.
+		select {
+		case <-self.stopCh:
+			return
+		case msg := <-self.priorityCh:
+			self.dispatch(msg)
+			continue
+		default:
+		}
+
+		if tokens <= 0 {
+			select {
+			case <-self.stopCh:
+				return
+			case msg := <-self.priorityCh:
+				self.dispatch(msg)
+			case <-ticker.C:
+				tokens++
+			}
+			continue
+		}
+
+		select {
+		case <-self.stopCh:
+			return
+		case msg := <-self.priorityCh:
+			self.dispatch(msg)
+		case msg := <-self.sendCh:
+			// The per-target bucket guards against flooding a live wire; while
+			// disconnected, dispatch queues onto the replay buffer instead of
+			// sending, so skip the check here, or messages buffered during an
+			// outage would be dropped instead of replayed once the connection
+			// comes back.
+			if target, ok := privmsgTarget(msg); ok && self.isConnected() && !self.allowTarget(target) {
+				log.Println("Per-target rate limit exceeded for", target, "- dropping message")
+				continue
+			}
+			self.dispatch(msg)
+			tokens--
+		case <-ticker.C:
+			if tokens < burst {
+				tokens++
+			}
+		}
+	}
+}
+
+// privmsgTarget extracts the target from a raw "PRIVMSG <target> :..." line,
+// for per-target rate limiting. ok is false for anything else (JOIN, MODE,
+// etc.), which isn't subject to a per-target limit.
+func privmsgTarget(msg string) (target string, ok bool) {
+	if !strings.HasPrefix(msg, "PRIVMSG ") {
+		return "", false
+	}
+
+	fields := strings.SplitN(msg, " ", 3)
+	if len(fields) < 2 {
+		return "", false
+	}
+
+	return fields[1], true
+}
+
+// targetBucket is a token bucket tracking the send rate to one PRIVMSG
+// target, independent of the connection-wide bucket runSender enforces.
+type targetBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether another message to this target may be sent now,
+// refilling at rate tokens/sec up to burst since the last call.
+func (self *targetBucket) allow(rate float64, burst int) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	now := time.Now()
+	if self.last.IsZero() {
+		self.tokens = float64(burst)
+	} else {
+		self.tokens += now.Sub(self.last).Seconds() * rate
+		if self.tokens > float64(burst) {
+			self.tokens = float64(burst)
+		}
+	}
+	self.last = now
+
+	if self.tokens < 1 {
+		return false
+	}
+	self.tokens--
+	return true
+}
+
+// allowTarget reports whether a PRIVMSG to target may be sent now, per its
+// own independent targetBucket, lazily created on first use.
+func (self *External) allowTarget(target string) bool {
+	self.perTargetMu.Lock()
+	bucket, ok := self.perTargetBuckets[target]
+	if !ok {
+		if self.perTargetBuckets == nil {
+			self.perTargetBuckets = make(map[string]*targetBucket)
+		}
+		bucket = &targetBucket{}
+		self.perTargetBuckets[target] = bucket
+	}
+	self.perTargetMu.Unlock()
+
+	return bucket.allow(defaultPerTargetRate, defaultPerTargetBurst)
+}
+
+// isPriorityCommand reports whether msg must bypass the token bucket:
+// PONGs (to answer server pings promptly) and CAP/SASL traffic (which must
+// complete registration before anything else goes out).
+func isPriorityCommand(msg string) bool {
+	for _, prefix := range []string{"PONG", "CAP ", "AUTHENTICATE"} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMessage breaks msg into chunks that fit the negotiated line length
+// budget (RPL_ISUPPORT LINELEN, defaulting to 512 bytes), leaving room for
+// the ":nick!user@host PRIVMSG target :" prefix the server will prepend
+// when relaying it to other clients. Splits happen on word boundaries
+// where possible, and never in the middle of a UTF-8 codepoint.
+func (self *External) splitMessage(target, msg string) []string {
+
+	budget := self.messageBudget(target)
+	if len(msg) <= budget {
+		return []string{msg}
+	}
+
+	var chunks []string
+	for len(msg) > budget {
+		cut := runeBoundaryAt(msg, budget)
+
+		if space := strings.LastIndex(msg[:cut], " "); space > 0 {
+			cut = space
+		}
+
+		chunks = append(chunks, msg[:cut])
+		msg = strings.TrimLeft(msg[cut:], " ")
+	}
+	chunks = append(chunks, msg)
+
+	return chunks
+}
+
+// runeBoundaryAt returns the largest index <= budget that falls on a UTF-8
+// rune boundary in msg, so a caller can safely slice msg[:idx] without
+// splitting a multi-byte codepoint. If budget falls inside msg's very
+// first rune, it returns the end of that rune instead, so callers always
+// make forward progress.
+func runeBoundaryAt(msg string, budget int) int {
+	cut := budget
+	for cut > 0 && !utf8.RuneStart(msg[cut]) {
+		cut--
+	}
+
+	if cut == 0 {
+		_, size := utf8.DecodeRuneInString(msg)
+		cut = size
+	}
+
+	return cut
+}
+
+// messageBudget returns how many bytes of PRIVMSG text fit in one line to
+// target, after accounting for the server's advertised line length and the
+// prefix the server will prepend when relaying the message (plus CRLF).
+func (self *External) messageBudget(target string) int {
+
+	self.isupportMu.RLock()
+	lineLen := self.lineLen
+	self.isupportMu.RUnlock()
+	if lineLen <= 0 {
+		lineLen = defaultLineLen
+	}
+
+	prefixLen := len(":"+self.ownHostmask()+" PRIVMSG "+target+" :") + len("\r\n")
+
+	budget := lineLen - prefixLen
+	if budget < 1 {
+		budget = 1
+	}
+
+	return budget
+}
+
+// ownHostmask returns the fullest nick!user@host we've learned for
+// ourselves so far, falling back to just the nick before the server has
+// told us anything more.
+func (self *External) ownHostmask() string {
+	self.ownMaskMu.RLock()
+	defer self.ownMaskMu.RUnlock()
+
+	if self.ownMask != "" {
+		return self.ownMask
+	}
+	return self.config.Nick
+}
+
+// learnOwnMask opportunistically records our own nick!user@host whenever
+// the server sends us a line with it attached (e.g. our own echoed
+// PRIVMSG, or any line where we happen to be the source), so SendMessage
+// can size outgoing lines accurately.
+func (self *External) learnOwnMask(line *Line) {
+	if line.User == "" || !strings.Contains(line.User, "!") {
+		return
+	}
+
+	nick := strings.SplitN(line.User, "!", 2)[0]
+	if nick != self.config.Nick {
+		return
+	}
+
+	self.ownMaskMu.Lock()
+	self.ownMask = line.User
+	self.ownMaskMu.Unlock()
+}
+
+// parseISupport reads LINELEN and MAXTARGETS out of an RPL_ISUPPORT (005)
+// line. Args is expected to look like [nick, TOKEN=VALUE, ..., "are
+// supported by this server"]; unrecognized tokens are ignored.
+func (self *External) parseISupport(line *Line) {
+	if len(line.Args) < 2 {
+		return
+	}
+
+	tokens := line.Args[1 : len(line.Args)-1]
+
+	self.isupportMu.Lock()
+	defer self.isupportMu.Unlock()
+
+	for _, token := range tokens {
+		parts := strings.SplitN(token, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+
+		switch parts[0] {
+		case "LINELEN":
+			self.lineLen = value
+		case "MAXTARGETS":
+			self.maxTargets = value
+		}
+	}
+}
+
+// targetGroups splits a possibly comma-separated PRIVMSG target list into
+// groups of at most the server's advertised MAXTARGETS (RPL_ISUPPORT), so a
+// single PRIVMSG never addresses more targets than the server allows.
+// Returns targets as a single group, unsplit, until MAXTARGETS is learned.
+func (self *External) targetGroups(targets string) []string {
+
+	self.isupportMu.RLock()
+	maxTargets := self.maxTargets
+	self.isupportMu.RUnlock()
+
+	all := strings.Split(targets, ",")
+	if maxTargets <= 0 || len(all) <= maxTargets {
+		return []string{targets}
+	}
+
+	var groups []string
+	for len(all) > 0 {
+		n := maxTargets
+		if n > len(all) {
+			n = len(all)
+		}
+		groups = append(groups, strings.Join(all[:n], ","))
+		all = all[n:]
+	}
+
+	return groups
+}
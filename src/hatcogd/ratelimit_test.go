@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSplitMessageRuneBoundary(t *testing.T) {
+	conn := &External{config: ExternalConfig{Nick: "nick"}}
+	conn.lineLen = 40 // force small chunks
+
+	msg := strings.Repeat("a", 10) + strings.Repeat("ä", 10)
+	chunks := conn.splitMessage("#chan", msg)
+
+	if len(chunks) < 2 {
+		t.Fatalf("expected message to be split, got %d chunk(s)", len(chunks))
+	}
+
+	for _, chunk := range chunks {
+		if !utf8.ValidString(chunk) {
+			t.Errorf("chunk %q is not valid UTF-8", chunk)
+		}
+	}
+
+	if got := strings.Join(chunks, ""); got != msg {
+		t.Errorf("rejoined chunks = %q, want %q", got, msg)
+	}
+}
+
+func TestTargetGroups(t *testing.T) {
+	conn := &External{}
+	conn.maxTargets = 2
+
+	got := conn.targetGroups("#a,#b,#c,#d,#e")
+	want := []string{"#a,#b", "#c,#d", "#e"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("targetGroups = %v, want %v", got, want)
+	}
+}
+
+func TestTargetGroupsUnknownMaxTargets(t *testing.T) {
+	conn := &External{}
+
+	got := conn.targetGroups("#a,#b,#c")
+	want := []string{"#a,#b,#c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("targetGroups = %v, want %v", got, want)
+	}
+}
+
+func TestPrivmsgTarget(t *testing.T) {
+	target, ok := privmsgTarget("PRIVMSG #chan :hello there")
+	if !ok || target != "#chan" {
+		t.Errorf("privmsgTarget(PRIVMSG) = (%q, %v), want (#chan, true)", target, ok)
+	}
+
+	if _, ok := privmsgTarget("JOIN #chan"); ok {
+		t.Error("privmsgTarget(JOIN) should not match")
+	}
+}
+
+// TestRunSenderSkipsPerTargetLimitWhileDisconnected verifies that runSender
+// doesn't apply the per-target burst limit to a disconnected connection:
+// every message must reach dispatch (and so the replay buffer) instead of
+// being dropped once defaultPerTargetBurst is exceeded, since the bucket
+// exists to protect a live wire, not outage buffering.
+func TestRunSenderSkipsPerTargetLimitWhileDisconnected(t *testing.T) {
+	conn := &External{
+		// A high connection-wide rate so only the per-target limit under
+		// test can gate these sends.
+		config:     ExternalConfig{SendRate: 1000, SendBurst: 1000},
+		sendCh:     make(chan string, 16),
+		priorityCh: make(chan string, 1),
+		stopCh:     make(chan struct{}),
+		replay:     newRingBuffer(16),
+		rawLog:     log.New(io.Discard, "", 0),
+	}
+
+	total := defaultPerTargetBurst + 5
+	for i := 0; i < total; i++ {
+		conn.sendCh <- "PRIVMSG #chan :hello"
+	}
+
+	go conn.runSender()
+	time.Sleep(100 * time.Millisecond)
+	close(conn.stopCh)
+
+	if got := len(conn.replay.Drain()); got != total {
+		t.Errorf("replay buffer has %d messages, want %d - per-target limit must not drop messages while disconnected", got, total)
+	}
+}
+
+func TestTargetBucketAllow(t *testing.T) {
+	bucket := &targetBucket{}
+
+	allowed := 0
+	for i := 0; i < defaultPerTargetBurst+2; i++ {
+		if bucket.allow(defaultPerTargetRate, defaultPerTargetBurst) {
+			allowed++
+		}
+	}
+
+	if allowed != defaultPerTargetBurst {
+		t.Errorf("allowed %d sends before exhausting burst, want %d", allowed, defaultPerTargetBurst)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	reconnectBaseDelay = 2 * time.Second
+	reconnectMaxDelay  = 5 * time.Minute
+
+	// Used when ExternalConfig.MaxReconnectAttempts is unset.
+	defaultMaxReconnectAttempts = 20
+
+	// Size of the per-connection outgoing message replay buffer.
+	replayBufferSize = 200
+)
+
+// ringBuffer is a small bounded FIFO holding outgoing messages queued while
+// a connection is down for reconnect. Pushing past size drops the oldest
+// entry rather than growing unbounded.
+type ringBuffer struct {
+	mu   sync.Mutex
+	buf  []string
+	size int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+func (self *ringBuffer) Push(msg string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.buf = append(self.buf, msg)
+	if len(self.buf) > self.size {
+		self.buf = self.buf[len(self.buf)-self.size:]
+	}
+}
+
+// Drain returns and clears all buffered messages, oldest first.
+func (self *ringBuffer) Drain() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	drained := self.buf
+	self.buf = nil
+	return drained
+}
+
+// backoffDelay returns a full-jitter exponential backoff delay for the
+// given (zero-based) attempt number: base 2s, doubling each attempt,
+// capped at 5m.
+func backoffDelay(attempt int) time.Duration {
+
+	upper := reconnectBaseDelay * time.Duration(int64(1)<<uint(attempt))
+	if upper > reconnectMaxDelay || upper <= 0 {
+		upper = reconnectMaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(upper)))
+}
+
+// reconnect redials self.config.Server with exponential backoff, re-runs
+// registration, rejoins previously-joined channels, and replays any
+// messages queued while the socket was down. It returns false if Stop was
+// called or MaxReconnectAttempts was exhausted, in which case the caller
+// should give up on this connection.
+func (self *External) reconnect() bool {
+
+	self.mu.Lock()
+	self.connected = false
+	self.socket.Close()
+	self.mu.Unlock()
+
+	self.emitSynthetic("RECONNECTING")
+
+	maxAttempts := self.config.MaxReconnectAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxReconnectAttempts
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+
+		select {
+		case <-self.stopCh:
+			return false
+		default:
+		}
+
+		delay := backoffDelay(attempt)
+		log.Printf("Reconnecting to %s in %s (attempt %d/%d)", self.config.Server, delay, attempt+1, maxAttempts)
+
+		select {
+		case <-self.stopCh:
+			return false
+		case <-time.After(delay):
+		}
+
+		applySts(&self.config)
+
+		socket, err := dialServer(self.config)
+		if err != nil {
+			log.Println("Reconnect attempt failed:", err)
+			continue
+		}
+
+		self.mu.Lock()
+		self.socket = socket
+		self.reader = bufio.NewReader(socket)
+		self.connected = true
+		self.mu.Unlock()
+
+		self.register()
+		self.rejoinChannels()
+		self.replayQueued()
+		self.emitSynthetic("RECONNECTED")
+
+		return true
+	}
+
+	return false
+}
+
+// rejoinChannels re-sends JOIN for every channel observed joined before the
+// connection dropped.
+func (self *External) rejoinChannels() {
+
+	self.channelsMu.Lock()
+	channels := make([]string, 0, len(self.channels))
+	for channel := range self.channels {
+		channels = append(channels, channel)
+	}
+	self.channelsMu.Unlock()
+
+	for _, channel := range channels {
+		self.SendRaw("JOIN " + channel)
+	}
+}
+
+// replayQueued flushes any messages that were queued on the replay buffer
+// while the connection was down.
+func (self *External) replayQueued() {
+	if self.replay == nil {
+		return
+	}
+
+	for _, msg := range self.replay.Drain() {
+		self.SendRaw(msg)
+	}
+}
+
+// emitSynthetic sends a synthetic Line to fromServer, carrying no wire
+// traffic, so clients can show reconnect status (e.g. RECONNECTING/
+// RECONNECTED).
+func (self *External) emitSynthetic(command string) {
+	self.fromServer <- &Line{Command: command}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestBackoffDelayBounds(t *testing.T) {
+	for attempt := 0; attempt < 12; attempt++ {
+		delay := backoffDelay(attempt)
+		if delay < 0 || delay > reconnectMaxDelay {
+			t.Errorf("backoffDelay(%d) = %v, want within [0, %v]", attempt, delay, reconnectMaxDelay)
+		}
+	}
+}
+
+func TestBackoffDelayCapsAtMaxDelay(t *testing.T) {
+	// A large attempt count would overflow the 1<<attempt shift without the
+	// cap; make sure it stays bounded instead.
+	delay := backoffDelay(63)
+	if delay > reconnectMaxDelay {
+		t.Errorf("backoffDelay(63) = %v, want <= %v", delay, reconnectMaxDelay)
+	}
+}
+
+func TestRingBufferPushAndDrain(t *testing.T) {
+	buf := newRingBuffer(3)
+
+	buf.Push("a")
+	buf.Push("b")
+	buf.Push("c")
+	buf.Push("d") // overflows, "a" should be dropped
+
+	got := buf.Drain()
+	want := []string{"b", "c", "d"}
+	if len(got) != len(want) {
+		t.Fatalf("Drain() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Drain()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	if drained := buf.Drain(); len(drained) != 0 {
+		t.Errorf("second Drain() = %v, want empty", drained)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildTlsConfig assembles the tls.Config used for every TLS dial: SNI from
+// host, an optional pinned-SPKI verifier, and an optional client
+// certificate for SASL EXTERNAL.
+func buildTlsConfig(host string, config ExternalConfig) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{ServerName: host}
+
+	if len(config.PinnedSPKIHashes) > 0 {
+		if config.Insecure {
+			log.Printf("WARNING: --insecure set, ignoring %d pinned SPKI hash(es) for %s", len(config.PinnedSPKIHashes), host)
+		} else {
+			tlsConfig.VerifyPeerCertificate = pinnedSPKIVerifier(config.PinnedSPKIHashes)
+		}
+	}
+
+	if config.ClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertPath, config.ClientCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate %q: %v", config.ClientCertPath, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// pinnedSPKIVerifier returns a tls.Config.VerifyPeerCertificate callback
+// that accepts the connection only if some certificate in the presented
+// chain has a SHA-256(SubjectPublicKeyInfo) matching one of pins (hex,
+// case-insensitive).
+func pinnedSPKIVerifier(pins []string) func([][]byte, [][]*x509.Certificate) error {
+
+	pinSet := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pinSet[strings.ToLower(pin)] = true
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pinSet[hex.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("tls: no certificate in chain matched a pinned SPKI hash")
+	}
+}
+
+/*******
+ * STS *
+ *******/
+
+// StsPolicy records an IRCv3 STS upgrade advertised by a host: redial at
+// Port over TLS until Learned+Duration.
+type StsPolicy struct {
+	Port     string    `json:"port"`
+	Duration int       `json:"duration"` // seconds
+	Learned  time.Time `json:"learned"`
+}
+
+func (policy StsPolicy) expired() bool {
+	return time.Now().After(policy.Learned.Add(time.Duration(policy.Duration) * time.Second))
+}
+
+// stsMu serializes all reads and writes of the on-disk STS policy file;
+// multiple External connections may learn or apply policies concurrently.
+var stsMu sync.Mutex
+
+func stsFilePath() string {
+	return HOME + LOG_DIR + "sts.json"
+}
+
+func loadStsPolicies() map[string]StsPolicy {
+
+	policies := map[string]StsPolicy{}
+
+	data, err := os.ReadFile(stsFilePath())
+	if err != nil {
+		return policies
+	}
+
+	if err := json.Unmarshal(data, &policies); err != nil {
+		log.Println("Invalid STS policy file, ignoring:", err)
+		return map[string]StsPolicy{}
+	}
+
+	return policies
+}
+
+// saveStsPolicies writes policies atomically (write to a temp file, then
+// rename over the real one) so a crash mid-write can't corrupt it.
+func saveStsPolicies(policies map[string]StsPolicy) {
+
+	data, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		log.Println("Error encoding STS policies:", err)
+		return
+	}
+
+	path := stsFilePath()
+	tmpPath := path + ".tmp"
+
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		log.Println("Error writing STS policy file:", err)
+		return
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		log.Println("Error saving STS policy file:", err)
+	}
+}
+
+// applySts upgrades config.Server in place to the STS-advertised TLS port
+// when a valid (unexpired) policy is on file for its host and the caller
+// wasn't already about to use TLS. Once a policy is in force, the caller
+// refuses to fall back to plaintext until it expires.
+func applySts(config *ExternalConfig) {
+
+	if isSSLAddr(config.Server) {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(config.Server)
+	if err != nil {
+		host = config.Server
+	}
+
+	stsMu.Lock()
+	policy, ok := loadStsPolicies()[host]
+	stsMu.Unlock()
+
+	if !ok || policy.expired() {
+		return
+	}
+
+	applyStsPolicy(config, host, policy)
+}
+
+// applyStsPolicy rewrites config in place to dial host over TLS at
+// policy.Port. Split out of applySts so the rewrite itself - including
+// forceTLS, which is what keeps dialServer from downgrading this to a
+// plaintext connection when policy.Port isn't SSL_PORT - can be exercised
+// without going through the on-disk policy store.
+func applyStsPolicy(config *ExternalConfig, host string, policy StsPolicy) {
+	log.Println("STS: upgrading connection to", host, "to TLS per stored policy")
+	config.Server = net.JoinHostPort(host, policy.Port)
+	config.forceTLS = true
+}
+
+// learnSts parses the "sts" CAP LS value (e.g.
+// "duration=2592000,port=6697") and persists or refreshes the policy for
+// server's host, so the next plaintext connection attempt upgrades
+// automatically.
+func learnSts(server string, usingTLS bool, value string) {
+
+	params := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 {
+			params[parts[0]] = parts[1]
+		}
+	}
+
+	duration, err := strconv.Atoi(params["duration"])
+	if err != nil {
+		log.Println("STS: ignoring CAP with invalid duration:", value)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+
+	// Default to the standard TLS port; the whole point of an sts policy
+	// is to redirect to TLS, so an omitted port= must never resolve to the
+	// current (possibly plaintext) port.
+	port := SSL_PORT
+	if advertisedPort, ok := params["port"]; ok {
+		port = advertisedPort
+	}
+
+	policy := StsPolicy{Port: port, Duration: duration, Learned: time.Now()}
+
+	stsMu.Lock()
+	policies := loadStsPolicies()
+	policies[host] = policy
+	saveStsPolicies(policies)
+	stsMu.Unlock()
+
+	if usingTLS {
+		log.Println("STS: refreshed policy for", host, "valid for", duration, "seconds")
+	} else {
+		log.Println("STS: learned policy for", host, "- future connections upgrade to port", port)
+	}
+}
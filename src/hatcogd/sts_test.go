@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestStsPolicyExpired(t *testing.T) {
+	fresh := StsPolicy{Duration: 3600, Learned: time.Now()}
+	if fresh.expired() {
+		t.Error("a policy learned just now with a 1h duration should not be expired")
+	}
+
+	stale := StsPolicy{Duration: 1, Learned: time.Now().Add(-time.Hour)}
+	if !stale.expired() {
+		t.Error("a policy learned an hour ago with a 1s duration should be expired")
+	}
+}
+
+func TestApplyStsPolicyForcesTLSOnNonStandardPort(t *testing.T) {
+	config := &ExternalConfig{Server: "irc.example.com:6667"}
+
+	applyStsPolicy(config, "irc.example.com", StsPolicy{Port: "7001"})
+
+	if config.Server != "irc.example.com:7001" {
+		t.Errorf("config.Server = %q, want irc.example.com:7001", config.Server)
+	}
+
+	// isSSLAddr alone can't recognize 7001 as a TLS port; requiresTLS -
+	// what dialServer actually calls - must still report true, or the
+	// STS upgrade would be silently downgraded to a plaintext dial.
+	if isSSLAddr(config.Server) {
+		t.Fatal("test is meaningless if isSSLAddr happens to recognize this port")
+	}
+	if !requiresTLS(*config) {
+		t.Error("requiresTLS(*config) = false after an STS upgrade to a non-standard port, want true")
+	}
+}
+
+func TestPinnedSPKIVerifierNoMatch(t *testing.T) {
+	verify := pinnedSPKIVerifier([]string{"0000000000000000000000000000000000000000000000000000000000000000"})
+
+	if err := verify([][]byte{}, nil); err == nil {
+		t.Error("expected an error when no certificate is presented")
+	}
+}
+
+func TestPinnedSPKIVerifierMatchesSPKIHash(t *testing.T) {
+	der, cert := generateTestCert(t)
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := hex.EncodeToString(sum[:])
+
+	verify := pinnedSPKIVerifier([]string{pin})
+	if err := verify([][]byte{der}, nil); err != nil {
+		t.Errorf("verify with the correct pin: %v", err)
+	}
+
+	verify = pinnedSPKIVerifier([]string{"wrong"})
+	if err := verify([][]byte{der}, nil); err == nil {
+		t.Error("verify with the wrong pin: expected an error, got nil")
+	}
+}
+
+// generateTestCert returns a self-signed certificate's raw DER and its
+// parsed form, for exercising pinnedSPKIVerifier without a real TLS dial.
+func generateTestCert(t *testing.T) ([]byte, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+
+	template := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating test certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing test certificate: %v", err)
+	}
+
+	return der, cert
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// The two IRCv3 websocket subprotocols hatcog understands: one raw IRC
+// line per frame, either as text or as binary.
+const (
+	textSubprotocol   = "text.ircv3.net"
+	binarySubprotocol = "binary.ircv3.net"
+)
+
+// WebsocketGatewayConfig configures a WebsocketGateway.
+type WebsocketGatewayConfig struct {
+	Addr string // e.g. ":8080"
+
+	// AllowedOrigins is checked against the Origin header of every
+	// handshake. Entries are either an exact host ("chat.example.com") or
+	// a "*.example.com" wildcard. A connection whose Origin matches
+	// nothing here is rejected.
+	AllowedOrigins []string
+
+	// CertFile/KeyFile, if both set, make the gateway terminate TLS itself
+	// instead of expecting a reverse proxy to do it.
+	CertFile string
+	KeyFile  string
+
+	// TrustedProxies lists CIDRs allowed to set X-Forwarded-For for the
+	// peer's real IP; requests from anywhere else get their TCP RemoteAddr.
+	TrustedProxies []string
+}
+
+// WebsocketGateway accepts browser IRC clients over WebSocket and bridges
+// them into the same ExternalManager pipeline the native client socket
+// uses: raw lines typed by the browser go to ExternalManager.SendRaw, and
+// raw lines seen on the wire are relayed back via ExternalManager.Subscribe.
+type WebsocketGateway struct {
+	config  WebsocketGatewayConfig
+	manager *ExternalManager
+	trusted []*net.IPNet
+}
+
+func NewWebsocketGateway(config WebsocketGatewayConfig, manager *ExternalManager) *WebsocketGateway {
+	return &WebsocketGateway{
+		config:  config,
+		manager: manager,
+		trusted: parseTrustedProxies(config.TrustedProxies),
+	}
+}
+
+func parseTrustedProxies(cidrs []string) []*net.IPNet {
+
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Println("Invalid trusted proxy CIDR, skipping:", cidr, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets
+}
+
+// ListenAndServe starts the gateway's HTTP(S) listener. Browser clients
+// connect to /ws/<network>, where <network> is the Server address of the
+// ExternalConfig passed to ExternalManager.Connect. It blocks until the
+// listener errors.
+func (self *WebsocketGateway) ListenAndServe() error {
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws/", websocket.Server{
+		Handshake: self.handshake,
+		Handler:   self.handleConn,
+	})
+
+	if self.config.CertFile != "" && self.config.KeyFile != "" {
+		return http.ListenAndServeTLS(self.config.Addr, self.config.CertFile, self.config.KeyFile, mux)
+	}
+
+	return http.ListenAndServe(self.config.Addr, mux)
+}
+
+// handshake validates Origin and picks one of our two supported
+// subprotocols, defaulting to text when the client didn't ask for one.
+func (self *WebsocketGateway) handshake(config *websocket.Config, req *http.Request) error {
+
+	origin := req.Header.Get("Origin")
+	if !self.originAllowed(origin) {
+		return fmt.Errorf("hatcogd: origin %q not allowed", origin)
+	}
+
+	for _, proto := range config.Protocol {
+		if proto == binarySubprotocol {
+			config.Protocol = []string{binarySubprotocol}
+			return nil
+		}
+	}
+
+	config.Protocol = []string{textSubprotocol}
+	return nil
+}
+
+// originAllowed checks origin's host against AllowedOrigins, supporting
+// exact matches and a leading "*." wildcard.
+func (self *WebsocketGateway) originAllowed(origin string) bool {
+
+	if len(self.config.AllowedOrigins) == 0 {
+		return false
+	}
+
+	host := origin
+	if idx := strings.Index(host, "://"); idx != -1 {
+		host = host[idx+len("://"):]
+	}
+	host = strings.SplitN(host, ":", 2)[0]
+
+	for _, allowed := range self.config.AllowedOrigins {
+		if allowed == origin || allowed == host {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sanitizeFrameLine trims all trailing CR/LF characters off line and reports
+// ok=false if anything else in it still contains a CR or LF. A frame must
+// be exactly one IRC line; an embedded CR/LF means a client is trying to
+// smuggle extra commands down the wire in a single frame, and the whole
+// frame must be rejected rather than passed through.
+func sanitizeFrameLine(line string) (sanitized string, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.ContainsAny(line, "\r\n") {
+		return "", false
+	}
+	return line, true
+}
+
+// networkFromPath pulls the network address out of a "/ws/<network>" path.
+func networkFromPath(path string) string {
+	return strings.TrimPrefix(path, "/ws/")
+}
+
+// peerAddr returns the client's real IP: X-Forwarded-For when req came
+// through a trusted proxy, otherwise the raw TCP RemoteAddr.
+func (self *WebsocketGateway) peerAddr(req *http.Request) string {
+
+	remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteHost = req.RemoteAddr
+	}
+
+	remoteIP := net.ParseIP(remoteHost)
+	if remoteIP == nil || !self.isTrustedProxy(remoteIP) {
+		return remoteHost
+	}
+
+	forwarded := req.Header.Get("X-Forwarded-For")
+	if forwarded == "" {
+		return remoteHost
+	}
+
+	// X-Forwarded-For may be a comma-separated chain; the first entry is
+	// the original client.
+	return strings.TrimSpace(strings.SplitN(forwarded, ",", 2)[0])
+}
+
+func (self *WebsocketGateway) isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range self.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleConn bridges one browser connection to its chosen network: it
+// forwards lines typed in the browser to ExternalManager.SendRaw, and
+// relays lines subscribed from that network's connection back out as
+// frames, until either side closes.
+func (self *WebsocketGateway) handleConn(ws *websocket.Conn) {
+	defer ws.Close()
+
+	network := networkFromPath(ws.Request().URL.Path)
+	peer := self.peerAddr(ws.Request())
+
+	id, lines, ok := self.manager.Subscribe(network)
+	if !ok {
+		log.Println("Websocket client", peer, "requested unknown network", network)
+		return
+	}
+	defer self.manager.Unsubscribe(network, id)
+
+	log.Println("Websocket client connected from", peer, "on", network)
+
+	binary := len(ws.Config().Protocol) > 0 && ws.Config().Protocol[0] == binarySubprotocol
+
+	done := make(chan struct{})
+	go self.pump(ws, lines, binary, done)
+
+	self.readLoop(ws, network, binary)
+	close(done)
+
+	log.Println("Websocket client disconnected:", peer)
+}
+
+// pump relays lines from the network's subscription out to the browser as
+// frames, until the connection is torn down.
+func (self *WebsocketGateway) pump(ws *websocket.Conn, lines <-chan string, binary bool, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+
+			var err error
+			if binary {
+				err = websocket.Message.Send(ws, []byte(line))
+			} else {
+				err = websocket.Message.Send(ws, line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop reads frames from the browser and forwards each one as a raw IRC
+// line to the chosen network, after sanitizeFrameLine: trailing CR/LF is
+// trimmed, frames with embedded CR/LF are dropped, and empty lines are
+// skipped.
+func (self *WebsocketGateway) readLoop(ws *websocket.Conn, network string, binary bool) {
+	for {
+		var line string
+
+		if binary {
+			var data []byte
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				return
+			}
+			line = string(data)
+		} else {
+			if err := websocket.Message.Receive(ws, &line); err != nil {
+				return
+			}
+		}
+
+		line, ok := sanitizeFrameLine(line)
+		if !ok {
+			log.Println("Websocket client on", network, "sent a frame with embedded CR/LF, dropping it")
+			continue
+		}
+		if line == "" {
+			continue
+		}
+
+		if !self.manager.SendRaw(network, line) {
+			return
+		}
+	}
+}
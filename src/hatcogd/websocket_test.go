@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestOriginAllowed(t *testing.T) {
+	gw := NewWebsocketGateway(WebsocketGatewayConfig{
+		AllowedOrigins: []string{"chat.example.com", "*.example.org"},
+	}, nil)
+
+	cases := map[string]bool{
+		"https://chat.example.com":     true,
+		"https://chat.example.com:443": true,
+		"http://evil.com":              false,
+		"https://sub.example.org":      true,
+		"https://example.org":          false,
+	}
+
+	for origin, want := range cases {
+		if got := gw.originAllowed(origin); got != want {
+			t.Errorf("originAllowed(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestOriginAllowedEmptyConfig(t *testing.T) {
+	gw := NewWebsocketGateway(WebsocketGatewayConfig{}, nil)
+
+	if gw.originAllowed("https://chat.example.com") {
+		t.Error("originAllowed with no AllowedOrigins configured should reject everything")
+	}
+}
+
+func TestSanitizeFrameLine(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"NICK foo\r\n", "NICK foo", true},
+		{"NICK foo", "NICK foo", true},
+		{"NICK x\r\nPRIVMSG #c :y", "", false},
+		{"NICK x\nPRIVMSG #c :y", "", false},
+	}
+
+	for _, c := range cases {
+		got, ok := sanitizeFrameLine(c.in)
+		if got != c.want || ok != c.ok {
+			t.Errorf("sanitizeFrameLine(%q) = (%q, %v), want (%q, %v)", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}